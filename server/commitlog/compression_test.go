@@ -0,0 +1,67 @@
+package commitlog
+
+import (
+	"testing"
+)
+
+// TestShouldCompressNoCompression checks that ShouldCompress always
+// returns false when the index has no compression configured, regardless
+// of CompressionPolicy.
+func TestShouldCompressNoCompression(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024})
+	if idx.ShouldCompress(0) {
+		t.Fatal("expected ShouldCompress to be false with CompressionNone")
+	}
+}
+
+// TestShouldCompressNilPolicy checks that, with compression enabled and no
+// CompressionPolicy, every message kind should be compressed.
+func TestShouldCompressNilPolicy(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024, Compression: CompressionSnappy})
+	for _, kind := range []uint8{0, 1, 255} {
+		if !idx.ShouldCompress(kind) {
+			t.Fatalf("expected ShouldCompress(%d) to be true with a nil policy", kind)
+		}
+	}
+}
+
+// TestShouldCompressWithPolicy checks that a non-nil CompressionPolicy
+// overrides the default per message kind, e.g. to bypass compression for
+// an already-compressed payload kind.
+func TestShouldCompressWithPolicy(t *testing.T) {
+	const alreadyCompressedKind = 7
+	policy := func(msgKind uint8) bool {
+		return msgKind != alreadyCompressedKind
+	}
+	idx := newTestIndex(t, options{
+		bytes:             1024,
+		Compression:       CompressionSnappy,
+		CompressionPolicy: policy,
+	})
+	if idx.ShouldCompress(alreadyCompressedKind) {
+		t.Fatal("expected the policy to veto compression for its excluded kind")
+	}
+	if !idx.ShouldCompress(1) {
+		t.Fatal("expected the policy to allow compression for other kinds")
+	}
+}
+
+// TestWriteEntriesRoundTripsSizeAndUncompressedSize verifies that Size and
+// UncompressedSize, which diverge only when compression is in play, are
+// preserved independently through a write/read round trip.
+func TestWriteEntriesRoundTripsSizeAndUncompressedSize(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024, Compression: CompressionSnappy})
+
+	entry := Entry{Offset: 0, Position: 0, Size: 6, UncompressedSize: 20}
+	if err := idx.WriteEntries([]Entry{entry}); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	var got Entry
+	if err := idx.ReadEntryAtFileOffset(&got, 0); err != nil {
+		t.Fatalf("ReadEntryAtFileOffset failed: %v", err)
+	}
+	if got.Size != 6 || got.UncompressedSize != 20 {
+		t.Fatalf("expected Size=6 UncompressedSize=20, got Size=%d UncompressedSize=%d", got.Size, got.UncompressedSize)
+	}
+}
@@ -0,0 +1,116 @@
+package commitlog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNewIndexWritesVersionedHeader checks that a freshly created index
+// file has the magic bytes, current version, and header-derived fields
+// (BaseOffset, SparseInterval, Compression) matching what was passed in.
+func TestNewIndexWritesVersionedHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "00000000000000000010.index")
+	idx, err := NewIndex(options{
+		path:           path,
+		bytes:          1024,
+		baseOffset:     10,
+		SparseInterval: 3,
+		Compression:    CompressionSnappy,
+	})
+	if err != nil {
+		t.Fatalf("NewIndex failed: %v", err)
+	}
+	if idx.legacy {
+		t.Fatal("expected a freshly created index not to be legacy")
+	}
+
+	h, err := idx.readHeader()
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	if h.Magic != indexMagic {
+		t.Fatalf("expected magic %v, got %v", indexMagic, h.Magic)
+	}
+	if h.Version != indexVersion {
+		t.Fatalf("expected version %d, got %d", indexVersion, h.Version)
+	}
+	if h.Flags&flagChecksum == 0 || h.Flags&flagCompression == 0 || h.Flags&flagSparse == 0 {
+		t.Fatalf("expected checksum, compression, and sparse flags set, got %b", h.Flags)
+	}
+	if h.BaseOffset != 10 {
+		t.Fatalf("expected BaseOffset 10, got %d", h.BaseOffset)
+	}
+	if h.SparseInterval != 3 {
+		t.Fatalf("expected SparseInterval 3, got %d", h.SparseInterval)
+	}
+	if Compression(h.Compression) != CompressionSnappy {
+		t.Fatalf("expected CompressionSnappy, got %d", h.Compression)
+	}
+}
+
+// TestNewIndexReconcilesOptionsFromHeaderOnReopen verifies that reopening
+// an existing index file reads SparseInterval, Compression, and BaseOffset
+// back from the persisted header rather than whatever the caller passes,
+// so a segment reopened with stale/default options still behaves as what
+// is actually on disk.
+func TestNewIndexReconcilesOptionsFromHeaderOnReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "00000000000000000000.index")
+	idx, err := NewIndex(options{
+		path:           path,
+		bytes:          1024,
+		SparseInterval: 5,
+		Compression:    CompressionSnappy,
+	})
+	if err != nil {
+		t.Fatalf("NewIndex failed: %v", err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := NewIndex(options{path: path, bytes: 1024})
+	if err != nil {
+		t.Fatalf("NewIndex (reopen) failed: %v", err)
+	}
+	if reopened.legacy {
+		t.Fatal("expected a versioned-header file not to be detected as legacy")
+	}
+	if reopened.SparseInterval != 5 {
+		t.Fatalf("expected SparseInterval 5 reconciled from header, got %d", reopened.SparseInterval)
+	}
+	if reopened.Compression != CompressionSnappy {
+		t.Fatalf("expected CompressionSnappy reconciled from header, got %d", reopened.Compression)
+	}
+}
+
+// TestNewIndexReadsLegacyHeaderlessFile checks that a pre-header index
+// file (no magic bytes at offset 0, and no header region at all) is
+// detected as legacy, opened read-only, and defaults to dense/
+// uncompressed regardless of the options passed in.
+func TestNewIndexReadsLegacyHeaderlessFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "00000000000000000000.index")
+	// A legacy file predates the header entirely, so fabricate one
+	// directly: legacyRelEntryWidth-aligned, all-zero (unwritten) entry
+	// bytes starting at offset 0, with no room reserved for indexMagic.
+	if err := os.WriteFile(path, make([]byte, 12*legacyRelEntryWidth), 0666); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	reopened, err := NewIndex(options{path: path, bytes: 1024, SparseInterval: 5, Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatalf("NewIndex (reopen) failed: %v", err)
+	}
+	if !reopened.legacy {
+		t.Fatal("expected a headerless file to be detected as legacy")
+	}
+	if reopened.SparseInterval != 0 {
+		t.Fatalf("expected legacy index to ignore the caller's SparseInterval, got %d", reopened.SparseInterval)
+	}
+	if reopened.Compression != CompressionNone {
+		t.Fatalf("expected legacy index to ignore the caller's Compression, got %d", reopened.Compression)
+	}
+	if err := reopened.WriteEntries([]Entry{{Offset: 0, Position: 0, Size: 10, UncompressedSize: 10}}); err == nil {
+		t.Fatal("expected WriteEntries to fail on a legacy index")
+	}
+}
@@ -3,54 +3,123 @@ package commitlog
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
-	"sort"
-	"sync"
 
 	"github.com/pkg/errors"
-	"github.com/tysontate/gommap"
 
 	"github.com/liftbridge-io/liftbridge/server/proto"
 )
 
 var (
 	ErrIndexCorrupt = errors.New("corrupt index file")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// indexMagic identifies a file as a versioned index. Pre-header files
+	// lack it and are read in their original, headerless layout.
+	indexMagic = [4]byte{0x1c, 0x1d, 0xb8, 0x88}
+)
+
+const (
+	offsetWidth           = 4
+	positionWidth         = 4
+	sizeWidth             = 4
+	uncompressedSizeWidth = 4
+	crcWidth              = 4
+	relEntryWidth         = offsetWidth + positionWidth + sizeWidth + uncompressedSizeWidth
+	entryWidth            = relEntryWidth + crcWidth
+
+	// headerSize is the encoded size of indexHeader; its trailing
+	// reserved bytes leave room to grow the format without another
+	// file-layout break.
+	headerSize = 32
+
+	indexVersion uint16 = 1
 )
 
+// Index header flags.
 const (
-	offsetWidth   = 4
-	positionWidth = 4
-	sizeWidth     = 4
-	entryWidth    = offsetWidth + positionWidth + sizeWidth
+	flagChecksum = 1 << iota
+	flagCompression
+	flagSparse
 )
 
+// Compression identifies the on-disk codec applied to segment records.
+// Index doesn't compress or decompress anything itself; it just tracks
+// each entry's on-disk Size and logical UncompressedSize.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+)
+
+// CompressionPolicy decides whether a message of the given kind should
+// be compressed, so already-compressed payloads can bypass it entirely.
+type CompressionPolicy func(msgKind uint8) bool
+
+// indexHeader is the fixed-size header written at offset 0 of every new
+// index file, ahead of the entry slots. SparseInterval and Compression
+// persist the actual options values, not just the Flags bits, so they
+// can be fully reconstructed from the header on reopen.
+type indexHeader struct {
+	Magic          [4]byte
+	Version        uint16
+	Flags          uint16
+	BaseOffset     int64
+	CreatedAt      int64
+	SparseInterval int32
+	Compression    uint8
+	_              [3]byte // reserved
+}
+
+// ErrIndexEntryChecksum is returned when an index entry fails CRC32
+// validation, e.g. because the broker crashed mid-write. It carries the
+// file offset of the bad entry so callers can truncate at the last
+// known-good boundary instead of giving up on the whole index.
+type ErrIndexEntryChecksum struct {
+	Offset int64
+}
+
+func (e *ErrIndexEntryChecksum) Error() string {
+	return fmt.Sprintf("index entry checksum mismatch at file offset %d", e.Offset)
+}
+
 type Index struct {
 	options
-	mmap     gommap.MMap
-	file     *os.File
-	mu       sync.RWMutex
-	position int64
+	*mmapFile
+
+	// legacy is true when the file predates the versioned header and is
+	// read in its original, checksum-less layout. It's read-only until
+	// the next segment roll recreates it in the current format.
+	legacy bool
 }
 
 type Entry struct {
 	Offset   int64
 	Position int64
-	Size     int32
+	// Size is the on-disk (possibly compressed) byte length.
+	Size int32
+	// UncompressedSize equals Size unless the record is compressed.
+	UncompressedSize int32
 }
 
 // relEntry is an Entry relative to the base fileOffset
 type relEntry struct {
-	Offset   int32
-	Position int32
-	Size     int32
+	Offset           int32
+	Position         int32
+	Size             int32
+	UncompressedSize int32
 }
 
 func newRelEntry(e Entry, baseOffset int64) relEntry {
 	return relEntry{
-		Offset:   int32(e.Offset - baseOffset),
-		Position: int32(e.Position),
-		Size:     e.Size,
+		Offset:           int32(e.Offset - baseOffset),
+		Position:         int32(e.Position),
+		Size:             e.Size,
+		UncompressedSize: e.UncompressedSize,
 	}
 }
 
@@ -58,14 +127,48 @@ func (rel relEntry) fill(e *Entry, baseOffset int64) {
 	e.Offset = baseOffset + int64(rel.Offset)
 	e.Position = int64(rel.Position)
 	e.Size = rel.Size
+	e.UncompressedSize = rel.UncompressedSize
+}
+
+// legacyRelEntryWidth is the on-disk entry size used before checksums and
+// a header were added: just Offset/Position/Size.
+const legacyRelEntryWidth = offsetWidth + positionWidth + sizeWidth
+
+// legacyRelEntry is the headerless, checksum-less relEntry format.
+type legacyRelEntry struct {
+	Offset   int32
+	Position int32
+	Size     int32
 }
 
 type options struct {
 	path       string
 	bytes      int64
 	baseOffset int64
+
+	// Repair instructs InitializePosition to tolerate a checksum failure
+	// as a truncation boundary instead of failing to open; see repair().
+	Repair bool
+
+	// SparseInterval, when greater than 1, indexes only every Nth
+	// message instead of every message. 0 or 1 means dense.
+	SparseInterval int
+
+	// Compression is the codec the segment writer applies to records.
+	Compression Compression
+
+	// CompressionPolicy, if set, decides per message kind whether to
+	// compress when Compression is not CompressionNone. It is not
+	// consulted when Compression is CompressionNone.
+	CompressionPolicy CompressionPolicy
+
+	// Evictor, if set, registers this index's mmapFile for cold-file
+	// eviction; see IndexEvictor.
+	Evictor *IndexEvictor
 }
 
+// NewIndex opens (or creates) the index file at opts.path. The caller
+// must call InitializePosition before WriteEntries or any offset lookup.
 func NewIndex(opts options) (idx *Index, err error) {
 	if opts.bytes == 0 {
 		opts.bytes = 10 * 1024 * 1024
@@ -73,39 +176,66 @@ func NewIndex(opts options) (idx *Index, err error) {
 	if opts.path == "" {
 		return nil, errors.New("path is empty")
 	}
-	idx = &Index{
-		options: opts,
+	idx = &Index{options: opts}
+
+	flags := uint16(flagChecksum)
+	if opts.Compression != CompressionNone {
+		flags |= flagCompression
 	}
-	idx.file, err = os.OpenFile(opts.path, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, errors.Wrap(err, "open file failed")
+	if opts.SparseInterval > 1 {
+		flags |= flagSparse
 	}
-	if err := idx.file.Truncate(roundDown(opts.bytes, entryWidth)); err != nil {
-		return nil, err
+	header := indexHeader{
+		Flags:          flags,
+		BaseOffset:     opts.baseOffset,
+		SparseInterval: int32(opts.SparseInterval),
+		Compression:    uint8(opts.Compression),
 	}
-	fi, err := idx.file.Stat()
+
+	mf, persisted, err := openMmapFile(opts.path, opts.bytes, entryWidth, legacyRelEntryWidth, &header, opts.Evictor)
 	if err != nil {
-		return nil, errors.Wrap(err, "stat file failed")
-	} else {
-		idx.position = fi.Size()
+		return nil, err
 	}
+	idx.mmapFile = mf
 
-	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
-	if err != nil {
-		return nil, errors.Wrap(err, "mmap file failed")
+	if persisted == nil {
+		// Headerless legacy file: read it dense and uncompressed until
+		// the next segment roll upgrades it.
+		idx.legacy = true
+		idx.SparseInterval = 0
+		idx.Compression = CompressionNone
+	} else {
+		// Reconcile options from the persisted header, not whatever the
+		// caller happened to pass in.
+		idx.baseOffset = persisted.BaseOffset
+		idx.SparseInterval = int(persisted.SparseInterval)
+		idx.Compression = Compression(persisted.Compression)
 	}
+
 	return idx, nil
 }
 
 func (idx *Index) WriteEntries(entries []Entry) (err error) {
+	if idx.legacy {
+		return errors.New("cannot write to a legacy index; it is read-only until the segment rolls")
+	}
 	b := new(bytes.Buffer)
 	for _, entry := range entries {
 		relEntry := newRelEntry(entry, idx.baseOffset)
-		if err = binary.Write(b, proto.Encoding, relEntry); err != nil {
+		relBuf := new(bytes.Buffer)
+		if err = binary.Write(relBuf, proto.Encoding, relEntry); err != nil {
 			return errors.Wrap(err, "binary write failed")
 		}
+		relBytes := relBuf.Bytes()
+		b.Write(relBytes)
+		checksum := crc32.Checksum(relBytes, crc32cTable)
+		if err = binary.Write(b, proto.Encoding, checksum); err != nil {
+			return errors.Wrap(err, "binary write failed")
+		}
+	}
+	if _, err := idx.WriteAt(b.Bytes(), idx.position); err != nil {
+		return err
 	}
-	idx.WriteAt(b.Bytes(), idx.position)
 	idx.mu.Lock()
 	idx.position += entryWidth * int64(len(entries))
 	idx.mu.Unlock()
@@ -114,95 +244,165 @@ func (idx *Index) WriteEntries(entries []Entry) (err error) {
 
 // ReadEntryAtFileOffset is used to read an Index entry at the given
 // byte offset of the Index file. ReadEntryAtLogOffset is generally
-// more useful for higher level use.
+// more useful for higher level use. The entry's CRC32 is validated
+// against its stored checksum, returning ErrIndexEntryChecksum on a
+// mismatch; an all-zero (unwritten) entry is not treated as corrupt.
 func (idx *Index) ReadEntryAtFileOffset(e *Entry, fileOffset int64) (err error) {
+	if idx.legacy {
+		return idx.readLegacyEntryAtFileOffset(e, fileOffset)
+	}
 	p := make([]byte, entryWidth)
 	if _, err = idx.ReadAt(p, fileOffset); err != nil {
 		return err
 	}
-	b := bytes.NewReader(p)
+	relBytes := p[:relEntryWidth]
+	b := bytes.NewReader(relBytes)
 	rel := &relEntry{}
-	err = binary.Read(b, proto.Encoding, rel)
-	if err != nil {
+	if err = binary.Read(b, proto.Encoding, rel); err != nil {
 		return errors.Wrap(err, "binary read failed")
 	}
+	var checksum uint32
+	if err = binary.Read(bytes.NewReader(p[relEntryWidth:]), proto.Encoding, &checksum); err != nil {
+		return errors.Wrap(err, "binary read failed")
+	}
+	if rel.Offset == 0 && rel.Position == 0 && rel.Size == 0 && rel.UncompressedSize == 0 && checksum == 0 {
+		idx.mu.RLock()
+		rel.fill(e, idx.baseOffset)
+		idx.mu.RUnlock()
+		return nil
+	}
+	if computed := crc32.Checksum(relBytes, crc32cTable); computed != checksum {
+		return &ErrIndexEntryChecksum{Offset: fileOffset}
+	}
 	idx.mu.RLock()
 	rel.fill(e, idx.baseOffset)
 	idx.mu.RUnlock()
 	return nil
 }
 
-// ReadEntryAtLogOffset is used to read an Index entry at the given
-// log offset of the Index file.
+// readLegacyEntryAtFileOffset reads a headerless, checksum-less entry.
+// Legacy indices predate compression too, so UncompressedSize is always
+// set equal to Size.
+func (idx *Index) readLegacyEntryAtFileOffset(e *Entry, fileOffset int64) error {
+	p := make([]byte, legacyRelEntryWidth)
+	if _, err := idx.ReadAt(p, fileOffset); err != nil {
+		return err
+	}
+	rel := &legacyRelEntry{}
+	if err := binary.Read(bytes.NewReader(p), proto.Encoding, rel); err != nil {
+		return errors.Wrap(err, "binary read failed")
+	}
+	idx.mu.RLock()
+	e.Offset = idx.baseOffset + int64(rel.Offset)
+	e.Position = int64(rel.Position)
+	e.Size = rel.Size
+	e.UncompressedSize = rel.Size
+	idx.mu.RUnlock()
+	return nil
+}
+
+// ReadEntryAtLogOffset reads an Index entry at or immediately before the
+// given log offset. With a sparse index, the returned entry may be for
+// an earlier offset than requested.
 func (idx *Index) ReadEntryAtLogOffset(e *Entry, logOffset int64) error {
-	return idx.ReadEntryAtFileOffset(e, logOffset*entryWidth)
+	entry, err := idx.LookupPosition(logOffset)
+	if err != nil {
+		return err
+	}
+	*e = entry
+	return nil
 }
 
-func (idx *Index) ReadAt(p []byte, offset int64) (n int, err error) {
+// LookupPosition returns the index entry at or immediately before the
+// given logical log offset via a binary search over the index's entry
+// slots. Callers resolve an exact record by scanning forward in the
+// segment data file from the returned Entry's Position.
+func (idx *Index) LookupPosition(offset int64) (Entry, error) {
 	idx.mu.RLock()
-	defer idx.mu.RUnlock()
-	if idx.position < offset+entryWidth {
-		return 0, io.EOF
+	n := int(idx.position / idx.entryWidth)
+	idx.mu.RUnlock()
+	if n == 0 {
+		return Entry{}, io.EOF
 	}
-	n = copy(p, idx.mmap[offset:offset+entryWidth])
-	return n, nil
-}
 
-func (idx *Index) WriteAt(p []byte, offset int64) (n int) {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
-	return copy(idx.mmap[offset:], p)
+	entry := Entry{}
+	// Find the first entry whose Offset is past the target; the entry
+	// immediately before it is the nearest indexed entry <= target. A
+	// manual loop, not sort.Search, so a checksum failure can abort the
+	// search immediately instead of being folded into its boolean
+	// return, where it could steer the search around the bad slot.
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if err := idx.ReadEntryAtFileOffset(&entry, int64(mid)*idx.entryWidth); err != nil {
+			return Entry{}, err
+		}
+		if entry.Offset > offset {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	i := lo
+	if i == 0 {
+		// Every indexed entry is past the target offset.
+		return Entry{}, io.EOF
+	}
+	if err := idx.ReadEntryAtFileOffset(&entry, int64(i-1)*idx.entryWidth); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
 }
 
-func (idx *Index) Sync() error {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
-	if err := idx.file.Sync(); err != nil {
-		return errors.Wrap(err, "file sync failed")
+// ShouldIndex reports whether the message at the given logical offset
+// should get an index entry, based on options.SparseInterval.
+func (idx *Index) ShouldIndex(offset int64) bool {
+	if idx.SparseInterval <= 1 {
+		return true
 	}
-	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return errors.Wrap(err, "mmap sync failed")
-	}
-	return nil
+	return (offset-idx.baseOffset)%int64(idx.SparseInterval) == 0
 }
 
-func (idx *Index) Close() (err error) {
-	if err = idx.Sync(); err != nil {
-		return
+// ShouldCompress reports whether a record of the given message kind
+// should be compressed, based on options.Compression and
+// options.CompressionPolicy.
+func (idx *Index) ShouldCompress(msgKind uint8) bool {
+	if idx.Compression == CompressionNone {
+		return false
 	}
-	if err = idx.file.Truncate(idx.position); err != nil {
-		return
+	if idx.CompressionPolicy == nil {
+		return true
 	}
-	return idx.file.Close()
+	return idx.CompressionPolicy(msgKind)
 }
 
-func (idx *Index) Name() string {
-	return idx.file.Name()
-}
+// ReadAt, WriteAt, Sync, Close, Name, and TruncateEntries are provided by
+// the embedded *mmapFile.
 
-func (idx *Index) TruncateEntries(number int) error {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
-	if int64(number*entryWidth) > idx.position {
-		return errors.New("bad truncate number")
+func (idx *Index) InitializePosition() (*Entry, error) {
+	if idx.Repair {
+		return idx.repair()
 	}
-	idx.position = int64(number * entryWidth)
-	return nil
-}
 
-func (idx *Index) InitializePosition() (*Entry, error) {
-	// Find the first empty entry.
-	n := int(idx.bytes / entryWidth)
+	// Find the first empty entry with a linear scan, not sort.Search: a
+	// checksum failure partway through makes "empty or checksum-bad"
+	// non-monotonic, so folding it into the search's boolean return
+	// could skip straight past a corrupt slot. Unlike repair(), a
+	// checksum failure here is fatal.
+	n := int(idx.bytes / idx.entryWidth)
 	entry := new(Entry)
-	i := sort.Search(n, func(i int) bool {
-		if err := idx.ReadEntryAtFileOffset(entry, int64(i*entryWidth)); err != nil {
-			panic(err)
+	i := 0
+	for ; i < n; i++ {
+		if err := idx.ReadEntryAtFileOffset(entry, int64(i)*idx.entryWidth); err != nil {
+			return nil, err
+		}
+		if entry.Position == 0 && entry.Size == 0 {
+			break
 		}
-		return entry.Position == 0 && entry.Size == 0
-	})
+	}
 	// Initialize the position.
 	idx.mu.Lock()
-	idx.position = int64(i * entryWidth)
+	idx.position = int64(i) * idx.entryWidth
 	idx.mu.Unlock()
 
 	if i == 0 {
@@ -212,7 +412,7 @@ func (idx *Index) InitializePosition() (*Entry, error) {
 
 	// Return the last entry in the index.
 	i--
-	if err := idx.ReadEntryAtFileOffset(entry, int64(i*entryWidth)); err != nil {
+	if err := idx.ReadEntryAtFileOffset(entry, int64(i)*idx.entryWidth); err != nil {
 		return nil, err
 	}
 	// Do some sanity checks.
@@ -221,12 +421,42 @@ func (idx *Index) InitializePosition() (*Entry, error) {
 	}
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	if idx.position%entryWidth != 0 {
+	if idx.position%idx.entryWidth != 0 {
 		return nil, ErrIndexCorrupt
 	}
 	return entry, nil
 }
 
+// repair walks the index forward from the first entry, stopping at the
+// first checksum failure or unwritten entry, and rewinds the index
+// position to that boundary. Unlike InitializePosition, it tolerates a
+// corrupt tail left behind by a crash mid-write, which segment recovery
+// needs in order to truncate at the last valid entry instead of giving
+// up.
+func (idx *Index) repair() (*Entry, error) {
+	n := int(idx.bytes / idx.entryWidth)
+	entry := new(Entry)
+	var last *Entry
+	i := 0
+	for ; i < n; i++ {
+		if err := idx.ReadEntryAtFileOffset(entry, int64(i)*idx.entryWidth); err != nil {
+			if _, ok := err.(*ErrIndexEntryChecksum); ok {
+				break
+			}
+			return nil, err
+		}
+		if entry.Position == 0 && entry.Size == 0 {
+			break
+		}
+		e := *entry
+		last = &e
+	}
+	idx.mu.Lock()
+	idx.position = int64(i) * idx.entryWidth
+	idx.mu.Unlock()
+	return last, nil
+}
+
 type IndexScanner struct {
 	idx    *Index
 	entry  *Entry
@@ -237,8 +467,11 @@ func NewIndexScanner(idx *Index) *IndexScanner {
 	return &IndexScanner{idx: idx, entry: &Entry{}}
 }
 
+// Scan reads index entries in slot order, i.e. the order they were
+// written, not by log offset. With a sparse index, consecutive entries
+// may skip over ranges of un-indexed log offsets.
 func (s *IndexScanner) Scan() (*Entry, error) {
-	err := s.idx.ReadEntryAtLogOffset(s.entry, s.offset)
+	err := s.idx.ReadEntryAtFileOffset(s.entry, s.offset*s.idx.entryWidth)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,105 @@
+package commitlog
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultIndexKeepalive is used when a commitlog is configured with an
+// IndexEvictor but leaves Keepalive at its zero value.
+const defaultIndexKeepalive = 30 * time.Second
+
+// IndexEvictor periodically unmaps the mmapFiles backing the Index and
+// TimeIndex of segments that haven't been read from or written to in a
+// while, keeping only their *os.File handles open. This bounds a
+// broker's resident memory when it holds thousands of segments, at the
+// cost of a re-mmap (tracked by liftbridge_index_remap_total) the next
+// time a cold segment is read from or written to. A segment's active
+// writer pins its Index and TimeIndex (see mmapFile.Pin) so it's never
+// evicted out from under an in-progress append.
+//
+// One IndexEvictor is shared by every segment of a commitlog; segments
+// register their mmapFiles with it as they're opened and unregister on
+// close.
+type IndexEvictor struct {
+	keepalive time.Duration
+	interval  time.Duration
+
+	mu    sync.Mutex
+	files map[*mmapFile]struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewIndexEvictor creates an IndexEvictor that unmaps files idle longer
+// than keepalive. A keepalive <= 0 uses defaultIndexKeepalive. Call Start
+// to begin sweeping.
+func NewIndexEvictor(keepalive time.Duration) *IndexEvictor {
+	if keepalive <= 0 {
+		keepalive = defaultIndexKeepalive
+	}
+	return &IndexEvictor{
+		keepalive: keepalive,
+		interval:  keepalive / 2,
+		files:     make(map[*mmapFile]struct{}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start runs the sweep loop in a new goroutine until Stop is called.
+func (e *IndexEvictor) Start() {
+	go e.loop()
+}
+
+// Stop ends the sweep loop. Files already evicted stay evicted; they're
+// re-mmapped lazily on their next ReadAt/WriteAt.
+func (e *IndexEvictor) Stop() {
+	e.stopOnce.Do(func() { close(e.stop) })
+}
+
+func (e *IndexEvictor) loop() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.sweep()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// sweep evicts every registered, unpinned file that's been idle for at
+// least e.keepalive. It snapshots the registered set under e.mu so the
+// per-file eviction checks, which take the file's own lock, don't happen
+// while holding the evictor's lock.
+func (e *IndexEvictor) sweep() {
+	e.mu.Lock()
+	files := make([]*mmapFile, 0, len(e.files))
+	for mf := range e.files {
+		files = append(files, mf)
+	}
+	e.mu.Unlock()
+
+	now := time.Now()
+	for _, mf := range files {
+		mf.evictIfIdle(now, e.keepalive)
+	}
+}
+
+// register adds mf to the set of files this evictor sweeps. Called by
+// openMmapFile when opened with a non-nil evictor.
+func (e *IndexEvictor) register(mf *mmapFile) {
+	e.mu.Lock()
+	e.files[mf] = struct{}{}
+	e.mu.Unlock()
+}
+
+// unregister removes mf, e.g. because its Index or TimeIndex was closed.
+func (e *IndexEvictor) unregister(mf *mmapFile) {
+	e.mu.Lock()
+	delete(e.files, mf)
+	e.mu.Unlock()
+}
@@ -0,0 +1,82 @@
+package commitlog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestIndexEvictorSweepUnmapsIdleFiles verifies that sweep() unmaps a file
+// that's been idle longer than keepalive, and that the next ReadAt/WriteAt
+// transparently re-mmaps it (incrementing indexRemapTotal) rather than
+// failing.
+func TestIndexEvictorSweepUnmapsIdleFiles(t *testing.T) {
+	evictor := NewIndexEvictor(time.Millisecond)
+	idx := newTestIndex(t, options{
+		path:    filepath.Join(t.TempDir(), "00000000000000000000.index"),
+		bytes:   1024,
+		Evictor: evictor,
+	})
+
+	if err := idx.WriteEntries([]Entry{{Offset: 0, Position: 0, Size: 10, UncompressedSize: 10}}); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	remapsBefore := testutil.ToFloat64(indexRemapTotal)
+
+	// Backdate lastAccess so the file looks idle without sleeping.
+	idx.mu.Lock()
+	idx.lastAccess = time.Now().Add(-time.Hour).UnixNano()
+	idx.mu.Unlock()
+
+	evictor.sweep()
+
+	idx.mu.RLock()
+	evicted := idx.mmap == nil
+	idx.mu.RUnlock()
+	if !evicted {
+		t.Fatal("expected sweep to unmap an idle, unpinned file")
+	}
+
+	// Reading from it should transparently remap it.
+	var e Entry
+	if err := idx.ReadEntryAtFileOffset(&e, 0); err != nil {
+		t.Fatalf("ReadEntryAtFileOffset after eviction failed: %v", err)
+	}
+	idx.mu.RLock()
+	remapped := idx.mmap != nil
+	idx.mu.RUnlock()
+	if !remapped {
+		t.Fatal("expected ReadAt to lazily remap the evicted file")
+	}
+	if got := testutil.ToFloat64(indexRemapTotal); got != remapsBefore+1 {
+		t.Fatalf("expected indexRemapTotal to increase by 1, got %v -> %v", remapsBefore, got)
+	}
+}
+
+// TestIndexEvictorSweepSkipsPinnedFiles verifies that a pinned file, e.g.
+// the active segment's index, is never evicted regardless of idle time.
+func TestIndexEvictorSweepSkipsPinnedFiles(t *testing.T) {
+	evictor := NewIndexEvictor(time.Millisecond)
+	idx := newTestIndex(t, options{
+		path:    filepath.Join(t.TempDir(), "00000000000000000000.index"),
+		bytes:   1024,
+		Evictor: evictor,
+	})
+	idx.Pin()
+
+	idx.mu.Lock()
+	idx.lastAccess = time.Now().Add(-time.Hour).UnixNano()
+	idx.mu.Unlock()
+
+	evictor.sweep()
+
+	idx.mu.RLock()
+	evicted := idx.mmap == nil
+	idx.mu.RUnlock()
+	if evicted {
+		t.Fatal("expected sweep to skip a pinned file")
+	}
+}
@@ -0,0 +1,104 @@
+package commitlog
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestIndex creates an Index backed by a fresh file in t.TempDir() (unless
+// opts.path is set) with the given options, so it has no evictor unless
+// opts.Evictor is set, and initializes its position the way any real caller
+// must before WriteEntries.
+func newTestIndex(t *testing.T, opts options) *Index {
+	t.Helper()
+	if opts.path == "" {
+		opts.path = filepath.Join(t.TempDir(), "00000000000000000000.index")
+	}
+	idx, err := NewIndex(opts)
+	if err != nil {
+		t.Fatalf("NewIndex failed: %v", err)
+	}
+	if _, err := idx.InitializePosition(); err != nil {
+		t.Fatalf("InitializePosition failed: %v", err)
+	}
+	return idx
+}
+
+// TestIndexRepairTruncatesCorruptTail writes a handful of valid entries,
+// then tampers with one entry's checksum to simulate a crash mid-write, and
+// verifies repair() stops at the last good entry and rewinds the position
+// to that boundary rather than failing the whole index open.
+func TestIndexRepairTruncatesCorruptTail(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024})
+
+	entries := []Entry{
+		{Offset: 0, Position: 0, Size: 10, UncompressedSize: 10},
+		{Offset: 1, Position: 10, Size: 10, UncompressedSize: 10},
+		{Offset: 2, Position: 20, Size: 10, UncompressedSize: 10},
+	}
+	if err := idx.WriteEntries(entries); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	// Tamper with the last entry's checksum byte to simulate a torn write.
+	corruptOffset := idx.headerOffset + 2*entryWidth
+	var b [1]byte
+	if _, err := idx.file.ReadAt(b[:], corruptOffset+entryWidth-1); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := idx.file.WriteAt(b[:], corruptOffset+entryWidth-1); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	idx.Repair = true
+	last, err := idx.InitializePosition()
+	if err != nil {
+		t.Fatalf("InitializePosition (repair) failed: %v", err)
+	}
+	if last == nil || last.Offset != 1 {
+		t.Fatalf("expected repair to stop after offset 1, got %+v", last)
+	}
+	if idx.position != 2*entryWidth {
+		t.Fatalf("expected position to rewind to 2 entries, got %d", idx.position)
+	}
+
+	// The tampered entry itself should still fail checksum validation.
+	var e Entry
+	err = idx.ReadEntryAtFileOffset(&e, 2*entryWidth)
+	if _, ok := err.(*ErrIndexEntryChecksum); !ok {
+		t.Fatalf("expected ErrIndexEntryChecksum reading the tampered entry, got %v", err)
+	}
+}
+
+// TestIndexInitializePositionDetectsChecksumFailure exercises the
+// non-repair, linear-scan path: a checksum failure partway through the
+// index should be surfaced as ErrIndexEntryChecksum rather than treated as
+// the end of the index or silently ignored.
+func TestIndexInitializePositionDetectsChecksumFailure(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024})
+
+	entries := []Entry{
+		{Offset: 0, Position: 0, Size: 10, UncompressedSize: 10},
+		{Offset: 1, Position: 10, Size: 10, UncompressedSize: 10},
+	}
+	if err := idx.WriteEntries(entries); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	corruptOffset := idx.headerOffset
+	var b [1]byte
+	if _, err := idx.file.ReadAt(b[:], corruptOffset+entryWidth-1); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := idx.file.WriteAt(b[:], corruptOffset+entryWidth-1); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	if _, err := idx.InitializePosition(); err == nil {
+		t.Fatal("expected InitializePosition to fail on a tampered entry")
+	} else if _, ok := err.(*ErrIndexEntryChecksum); !ok {
+		t.Fatalf("expected ErrIndexEntryChecksum, got %v", err)
+	}
+}
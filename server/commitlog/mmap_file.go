@@ -0,0 +1,327 @@
+package commitlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tysontate/gommap"
+
+	"github.com/liftbridge-io/liftbridge/server/proto"
+)
+
+var (
+	indexMmapOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "liftbridge_index_mmap_open",
+		Help: "Number of index/time-index files currently mmapped in memory",
+	})
+	indexRemapTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "liftbridge_index_remap_total",
+		Help: "Total number of times an evicted index/time-index was re-mmapped to serve a read or write",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(indexMmapOpen, indexRemapTotal)
+}
+
+// mmapFile is the memory-mapped-file scaffolding shared by Index and
+// TimeIndex: the backing file, the versioned header, fixed-width entry
+// slot I/O, and cold-file mmap eviction. It knows nothing about entry
+// encoding; callers read and write raw, entryWidth-sized slots at
+// entry-relative offsets (i.e. excluding the header).
+type mmapFile struct {
+	mmap       gommap.MMap // nil when evicted; the *os.File stays open
+	file       *os.File
+	mu         sync.RWMutex
+	entryWidth int64
+	// position is the number of entry bytes written, relative to
+	// headerOffset.
+	position int64
+	// headerOffset is headerSize for the versioned header, 0 for
+	// legacy, headerless files.
+	headerOffset int64
+
+	// lastAccess is a UnixNano timestamp an IndexEvictor uses to find
+	// cold files to unmap.
+	lastAccess int64
+	// pinned, when non-zero (see Pin/Unpin), means this file is never
+	// evicted, e.g. because it's the active segment's index.
+	pinned int32
+
+	// evictor, if non-nil, sweeps this file for cold-file eviction.
+	evictor *IndexEvictor
+}
+
+// openMmapFile opens (creating if necessary) path, truncates it to hold
+// the requested number of entry bytes plus a header, and mmaps it. If
+// the file is new, header is written to it (unless nil) and returned as
+// persisted; if it already carries the versioned header's magic, the
+// header is read back and returned instead. Headerless legacy files are
+// left in their original, narrower layout (persisted is nil) until the
+// next segment roll recreates them. If evictor is non-nil, the file is
+// registered with it for cold-file eviction.
+func openMmapFile(path string, bytes, entryWidth, legacyEntryWidth int64, header *indexHeader, evictor *IndexEvictor) (mf *mmapFile, persisted *indexHeader, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open file failed")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "stat file failed")
+	}
+	isNew := fi.Size() == 0
+	legacy := !isNew && !fileHasIndexMagic(f)
+
+	width := entryWidth
+	if legacy {
+		width = legacyEntryWidth
+	}
+
+	mf = &mmapFile{file: f, entryWidth: width, headerOffset: headerSize, evictor: evictor}
+	if legacy {
+		mf.headerOffset = 0
+	}
+
+	if err := f.Truncate(mf.headerOffset + roundDown(bytes, width)); err != nil {
+		return nil, nil, err
+	}
+
+	if err := mf.mapNow(false); err != nil {
+		return nil, nil, err
+	}
+
+	if isNew {
+		if header != nil {
+			if err := mf.writeHeader(*header); err != nil {
+				return nil, nil, err
+			}
+			h, err := mf.readHeader()
+			if err != nil {
+				return nil, nil, err
+			}
+			persisted = &h
+		}
+	} else if mf.headerOffset > 0 {
+		h, err := mf.readHeader()
+		if err != nil {
+			return nil, nil, err
+		}
+		persisted = &h
+	}
+
+	if fi, err = f.Stat(); err != nil {
+		return nil, nil, errors.Wrap(err, "stat file failed")
+	}
+	mf.position = fi.Size() - mf.headerOffset
+
+	if evictor != nil {
+		evictor.register(mf)
+	}
+
+	return mf, persisted, nil
+}
+
+// mapNow mmaps the file, replacing any existing mapping. remap should be
+// true when re-mmapping a file an IndexEvictor had previously unmapped,
+// so indexRemapTotal reflects only re-mmaps, not the initial open.
+func (mf *mmapFile) mapNow(remap bool) error {
+	m, err := gommap.Map(mf.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return errors.Wrap(err, "mmap file failed")
+	}
+	mf.mmap = m
+	atomic.StoreInt64(&mf.lastAccess, time.Now().UnixNano())
+	indexMmapOpen.Inc()
+	if remap {
+		indexRemapTotal.Inc()
+	}
+	return nil
+}
+
+// remap re-mmaps the file if it's currently evicted. It's a no-op if the
+// file is already mapped.
+func (mf *mmapFile) remap() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.mmap != nil {
+		return nil
+	}
+	return mf.mapNow(true)
+}
+
+// Pin marks the file as never evicted. The active segment's writer pins
+// its Index and TimeIndex for as long as it keeps appending to them.
+func (mf *mmapFile) Pin() {
+	atomic.StoreInt32(&mf.pinned, 1)
+}
+
+// Unpin reverses Pin, e.g. once a segment is no longer the active
+// writer, making the file eligible for the next idle sweep.
+func (mf *mmapFile) Unpin() {
+	atomic.StoreInt32(&mf.pinned, 0)
+}
+
+// evictIfIdle unmaps the file, keeping only the *os.File handle open, if
+// it isn't pinned and hasn't been touched in at least keepalive. It's
+// called by IndexEvictor's sweep loop, never directly by readers/writers.
+func (mf *mmapFile) evictIfIdle(now time.Time, keepalive time.Duration) {
+	if atomic.LoadInt32(&mf.pinned) != 0 {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.mmap == nil {
+		return
+	}
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&mf.lastAccess))) < keepalive {
+		return
+	}
+	if err := mf.mmap.UnsafeUnmap(); err != nil {
+		return
+	}
+	mf.mmap = nil
+	indexMmapOpen.Dec()
+}
+
+// fileHasIndexMagic reports whether f starts with the versioned index
+// header's magic bytes.
+func fileHasIndexMagic(f *os.File) bool {
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+	return magic == indexMagic
+}
+
+func (mf *mmapFile) writeHeader(h indexHeader) error {
+	h.Magic = indexMagic
+	h.Version = indexVersion
+	h.CreatedAt = time.Now().UnixNano()
+	b := new(bytes.Buffer)
+	if err := binary.Write(b, proto.Encoding, h); err != nil {
+		return errors.Wrap(err, "binary write failed")
+	}
+	copy(mf.mmap[:headerSize], b.Bytes())
+	return nil
+}
+
+func (mf *mmapFile) readHeader() (indexHeader, error) {
+	h := indexHeader{}
+	if err := binary.Read(bytes.NewReader(mf.mmap[:headerSize]), proto.Encoding, &h); err != nil {
+		return h, errors.Wrap(err, "binary read failed")
+	}
+	if h.Magic != indexMagic {
+		return h, ErrIndexCorrupt
+	}
+	if h.Version > indexVersion {
+		return h, errors.Errorf("unsupported index version %d", h.Version)
+	}
+	return h, nil
+}
+
+// ReadAt and WriteAt take an offset relative to the start of the entry
+// region, i.e. excluding the header. ReadAt always reads exactly
+// entryWidth bytes; WriteAt writes all of p, which may hold several
+// entries. Both lazily re-mmap the file first if an IndexEvictor had
+// unmapped it for being idle.
+//
+// ReadAt is bounded by the physical size of the mmap, not the logical
+// position: InitializePosition and repair() deliberately scan past
+// position, into the still-zero preallocated region, and need to see
+// those zero bytes rather than a bare io.EOF.
+func (mf *mmapFile) ReadAt(p []byte, offset int64) (n int, err error) {
+	mf.mu.RLock()
+	if mf.mmap == nil {
+		mf.mu.RUnlock()
+		if err := mf.remap(); err != nil {
+			return 0, err
+		}
+		mf.mu.RLock()
+	}
+	defer mf.mu.RUnlock()
+	atomic.StoreInt64(&mf.lastAccess, time.Now().UnixNano())
+	start := mf.headerOffset + offset
+	if start+mf.entryWidth > int64(len(mf.mmap)) {
+		return 0, io.EOF
+	}
+	n = copy(p, mf.mmap[start:start+mf.entryWidth])
+	return n, nil
+}
+
+func (mf *mmapFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.mmap == nil {
+		if err := mf.mapNow(true); err != nil {
+			return 0, err
+		}
+	}
+	atomic.StoreInt64(&mf.lastAccess, time.Now().UnixNano())
+	start := mf.headerOffset + offset
+	return copy(mf.mmap[start:], p), nil
+}
+
+func (mf *mmapFile) Sync() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if err := mf.file.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	if mf.mmap == nil {
+		return nil
+	}
+	if err := mf.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return errors.Wrap(err, "mmap sync failed")
+	}
+	return nil
+}
+
+// Close flushes the file, unmaps it if still mapped, and closes the
+// underlying *os.File. It holds mf.mu for the whole sequence so a sweep
+// already in flight (sweep snapshots its files before taking any file's
+// lock) can't unmap a mapping Close has already torn down.
+func (mf *mmapFile) Close() error {
+	if mf.evictor != nil {
+		mf.evictor.unregister(mf)
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if err := mf.file.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	if mf.mmap != nil {
+		if err := mf.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return errors.Wrap(err, "mmap sync failed")
+		}
+		if err := mf.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		mf.mmap = nil
+		indexMmapOpen.Dec()
+	}
+	if err := mf.file.Truncate(mf.headerOffset + mf.position); err != nil {
+		return err
+	}
+	return mf.file.Close()
+}
+
+func (mf *mmapFile) Name() string {
+	return mf.file.Name()
+}
+
+func (mf *mmapFile) TruncateEntries(number int) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if int64(number)*mf.entryWidth > mf.position {
+		return errors.New("bad truncate number")
+	}
+	mf.position = int64(number) * mf.entryWidth
+	return nil
+}
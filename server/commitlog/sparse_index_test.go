@@ -0,0 +1,79 @@
+package commitlog
+
+import (
+	"io"
+	"testing"
+)
+
+// TestLookupPositionSparseBetweenIndexedOffsets verifies that, with a
+// sparse index, LookupPosition returns the nearest indexed entry at or
+// before a requested offset that falls between two indexed offsets, rather
+// than failing or returning the wrong entry.
+func TestLookupPositionSparseBetweenIndexedOffsets(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024, SparseInterval: 3})
+
+	// Only offsets 0, 3, and 6 are indexed (ShouldIndex is the segment
+	// writer's responsibility; here we just write the sparse entries it
+	// would have chosen).
+	entries := []Entry{
+		{Offset: 0, Position: 0, Size: 10, UncompressedSize: 10},
+		{Offset: 3, Position: 10, Size: 10, UncompressedSize: 10},
+		{Offset: 6, Position: 20, Size: 10, UncompressedSize: 10},
+	}
+	if err := idx.WriteEntries(entries); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	// A lookup for offset 4, which falls between indexed offsets 3 and 6,
+	// should return the entry for 3.
+	entry, err := idx.LookupPosition(4)
+	if err != nil {
+		t.Fatalf("LookupPosition(4) failed: %v", err)
+	}
+	if entry.Offset != 3 {
+		t.Fatalf("expected nearest indexed entry at offset 3, got %d", entry.Offset)
+	}
+
+	// An exact match on an indexed offset returns that entry.
+	entry, err = idx.LookupPosition(6)
+	if err != nil {
+		t.Fatalf("LookupPosition(6) failed: %v", err)
+	}
+	if entry.Offset != 6 {
+		t.Fatalf("expected entry at offset 6, got %d", entry.Offset)
+	}
+
+	// A lookup past the last indexed offset returns the last entry.
+	entry, err = idx.LookupPosition(100)
+	if err != nil {
+		t.Fatalf("LookupPosition(100) failed: %v", err)
+	}
+	if entry.Offset != 6 {
+		t.Fatalf("expected last indexed entry at offset 6, got %d", entry.Offset)
+	}
+
+	// A lookup before the first indexed offset is io.EOF (the i==0 edge).
+	if _, err := idx.LookupPosition(-1); err != io.EOF {
+		t.Fatalf("expected io.EOF for an offset before the first entry, got %v", err)
+	}
+}
+
+// TestShouldIndexSparseInterval checks the ShouldIndex boundary: with a
+// SparseInterval of 3, only every third offset relative to baseOffset
+// should be indexed.
+func TestShouldIndexSparseInterval(t *testing.T) {
+	idx := newTestIndex(t, options{bytes: 1024, SparseInterval: 3, baseOffset: 10})
+
+	cases := map[int64]bool{
+		10: true,
+		11: false,
+		12: false,
+		13: true,
+		16: true,
+	}
+	for offset, want := range cases {
+		if got := idx.ShouldIndex(offset); got != want {
+			t.Errorf("ShouldIndex(%d) = %v, want %v", offset, got, want)
+		}
+	}
+}
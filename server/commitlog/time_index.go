@@ -0,0 +1,177 @@
+package commitlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/liftbridge-io/liftbridge/server/proto"
+)
+
+const (
+	timestampWidth = 8
+	offsetWidth64  = 8
+	timeEntryWidth = timestampWidth + offsetWidth64
+)
+
+// TimeEntry maps a wall-clock timestamp, in milliseconds, to the log
+// offset of the message that was current when it was written.
+type TimeEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+type timeIndexOptions struct {
+	path  string
+	bytes int64
+
+	// evictor, if set, registers this index's mmapFile for cold-file
+	// eviction; see IndexEvictor and Index.options.Evictor.
+	evictor *IndexEvictor
+}
+
+// TimeIndex is a secondary index alongside Index, mapping message
+// timestamps to log offsets instead of log offsets to file positions. It
+// shares Index's mmap/header scaffolding (via mmapFile) but is written
+// and searched by timestamp, which lets the broker trim whole segments
+// by age without scanning the data file and lets consumers resolve
+// "start from timestamp T" subscriptions to a log offset.
+type TimeIndex struct {
+	timeIndexOptions
+	*mmapFile
+}
+
+func NewTimeIndex(opts timeIndexOptions) (idx *TimeIndex, err error) {
+	if opts.bytes == 0 {
+		opts.bytes = 10 * 1024 * 1024
+	}
+	if opts.path == "" {
+		return nil, errors.New("path is empty")
+	}
+	idx = &TimeIndex{timeIndexOptions: opts}
+	idx.mmapFile, _, err = openMmapFile(opts.path, opts.bytes, timeEntryWidth, timeEntryWidth, &indexHeader{}, opts.evictor)
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.initializePosition(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// initializePosition finds the first empty entry slot and sets the
+// index's append position to it, the same way Index.InitializePosition
+// does for the offset index.
+func (idx *TimeIndex) initializePosition() error {
+	n := int(idx.bytes / timeEntryWidth)
+	entry := TimeEntry{}
+	i := 0
+	for ; i < n; i++ {
+		if err := idx.readEntryAtFileOffset(&entry, int64(i*timeEntryWidth)); err != nil {
+			return err
+		}
+		if entry.Timestamp == 0 && entry.Offset == 0 {
+			break
+		}
+	}
+	idx.mu.Lock()
+	idx.position = int64(i * timeEntryWidth)
+	idx.mu.Unlock()
+	return nil
+}
+
+// WriteEntries appends TimeEntry records to the index. The segment
+// writer calls this alongside Index.WriteEntries, passing the timestamp
+// of the first message in the batch.
+func (idx *TimeIndex) WriteEntries(entries []TimeEntry) error {
+	b := new(bytes.Buffer)
+	for _, entry := range entries {
+		if err := binary.Write(b, proto.Encoding, entry); err != nil {
+			return errors.Wrap(err, "binary write failed")
+		}
+	}
+	if _, err := idx.WriteAt(b.Bytes(), idx.position); err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	idx.position += timeEntryWidth * int64(len(entries))
+	idx.mu.Unlock()
+	return nil
+}
+
+func (idx *TimeIndex) readEntryAtFileOffset(e *TimeEntry, fileOffset int64) error {
+	p := make([]byte, timeEntryWidth)
+	if _, err := idx.ReadAt(p, fileOffset); err != nil {
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(p), proto.Encoding, e); err != nil {
+		return errors.Wrap(err, "binary read failed")
+	}
+	return nil
+}
+
+// LookupOffsetAtOrBefore returns the log offset of the latest indexed
+// entry whose timestamp is at or before ts, found via a binary search
+// over the mmap. It returns io.EOF if every indexed entry is after ts.
+func (idx *TimeIndex) LookupOffsetAtOrBefore(ts int64) (int64, error) {
+	idx.mu.RLock()
+	n := int(idx.position / timeEntryWidth)
+	idx.mu.RUnlock()
+	if n == 0 {
+		return 0, io.EOF
+	}
+	entry := TimeEntry{}
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if err := idx.readEntryAtFileOffset(&entry, int64(mid*timeEntryWidth)); err != nil {
+			return 0, err
+		}
+		if entry.Timestamp > ts {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == 0 {
+		return 0, io.EOF
+	}
+	if err := idx.readEntryAtFileOffset(&entry, int64((lo-1)*timeEntryWidth)); err != nil {
+		return 0, err
+	}
+	return entry.Offset, nil
+}
+
+// EarliestAfter returns the log offset of the earliest indexed entry
+// whose timestamp is at or after ts. It returns io.EOF if every indexed
+// entry is before ts.
+func (idx *TimeIndex) EarliestAfter(ts int64) (int64, error) {
+	idx.mu.RLock()
+	n := int(idx.position / timeEntryWidth)
+	idx.mu.RUnlock()
+	if n == 0 {
+		return 0, io.EOF
+	}
+	entry := TimeEntry{}
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if err := idx.readEntryAtFileOffset(&entry, int64(mid*timeEntryWidth)); err != nil {
+			return 0, err
+		}
+		if entry.Timestamp >= ts {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == n {
+		return 0, io.EOF
+	}
+	if err := idx.readEntryAtFileOffset(&entry, int64(lo*timeEntryWidth)); err != nil {
+		return 0, err
+	}
+	return entry.Offset, nil
+}
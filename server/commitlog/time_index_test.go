@@ -0,0 +1,101 @@
+package commitlog
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func newTestTimeIndex(t *testing.T) *TimeIndex {
+	t.Helper()
+	idx, err := NewTimeIndex(timeIndexOptions{
+		path:  filepath.Join(t.TempDir(), "00000000000000000000.timeindex"),
+		bytes: 1024,
+	})
+	if err != nil {
+		t.Fatalf("NewTimeIndex failed: %v", err)
+	}
+	return idx
+}
+
+// TestTimeIndexLookupOffsetAtOrBefore covers the exact-match and
+// between-entries cases, plus the i==0 edge where every indexed timestamp
+// is after the query.
+func TestTimeIndexLookupOffsetAtOrBefore(t *testing.T) {
+	idx := newTestTimeIndex(t)
+	entries := []TimeEntry{
+		{Timestamp: 100, Offset: 0},
+		{Timestamp: 200, Offset: 1},
+		{Timestamp: 300, Offset: 2},
+	}
+	if err := idx.WriteEntries(entries); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	// Exact match.
+	if offset, err := idx.LookupOffsetAtOrBefore(200); err != nil {
+		t.Fatalf("LookupOffsetAtOrBefore(200) failed: %v", err)
+	} else if offset != 1 {
+		t.Fatalf("expected offset 1, got %d", offset)
+	}
+
+	// Between entries.
+	if offset, err := idx.LookupOffsetAtOrBefore(250); err != nil {
+		t.Fatalf("LookupOffsetAtOrBefore(250) failed: %v", err)
+	} else if offset != 1 {
+		t.Fatalf("expected offset 1, got %d", offset)
+	}
+
+	// After every entry.
+	if offset, err := idx.LookupOffsetAtOrBefore(1000); err != nil {
+		t.Fatalf("LookupOffsetAtOrBefore(1000) failed: %v", err)
+	} else if offset != 2 {
+		t.Fatalf("expected offset 2, got %d", offset)
+	}
+
+	// Before every entry: the i==0 edge.
+	if _, err := idx.LookupOffsetAtOrBefore(50); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+// TestTimeIndexEarliestAfter covers the exact-match and between-entries
+// cases, plus the i==n edge where every indexed timestamp is before the
+// query.
+func TestTimeIndexEarliestAfter(t *testing.T) {
+	idx := newTestTimeIndex(t)
+	entries := []TimeEntry{
+		{Timestamp: 100, Offset: 0},
+		{Timestamp: 200, Offset: 1},
+		{Timestamp: 300, Offset: 2},
+	}
+	if err := idx.WriteEntries(entries); err != nil {
+		t.Fatalf("WriteEntries failed: %v", err)
+	}
+
+	// Exact match.
+	if offset, err := idx.EarliestAfter(200); err != nil {
+		t.Fatalf("EarliestAfter(200) failed: %v", err)
+	} else if offset != 1 {
+		t.Fatalf("expected offset 1, got %d", offset)
+	}
+
+	// Between entries.
+	if offset, err := idx.EarliestAfter(150); err != nil {
+		t.Fatalf("EarliestAfter(150) failed: %v", err)
+	} else if offset != 1 {
+		t.Fatalf("expected offset 1, got %d", offset)
+	}
+
+	// Before every entry.
+	if offset, err := idx.EarliestAfter(0); err != nil {
+		t.Fatalf("EarliestAfter(0) failed: %v", err)
+	} else if offset != 0 {
+		t.Fatalf("expected offset 0, got %d", offset)
+	}
+
+	// After every entry: the i==n edge.
+	if _, err := idx.EarliestAfter(1000); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}